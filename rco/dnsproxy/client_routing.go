@@ -0,0 +1,130 @@
+package dnsproxy
+
+import (
+	"net/netip"
+
+	"github.com/prometheus/common/log"
+)
+
+// ClientRoute maps a client source CIDR to the upstream pool that should
+// serve it, e.g. routing a guest network through filtered upstreams while
+// corp clients use internal resolvers. Upstreams may be listed inline or,
+// like DomainRoute, reference a named pool shared with other routes.
+type ClientRoute struct {
+	CIDR      string           `mapstructure:"CIDR"`
+	Pool      string           `mapstructure:"Pool"`
+	Upstreams []UpstreamServer `mapstructure:"Upstreams"`
+}
+
+// clientTrieNode is a node of the binary prefix trie, one bit per level,
+// walked from the most-significant bit down.
+type clientTrieNode struct {
+	children [2]*clientTrieNode
+	view     ServersView
+	isLeaf   bool
+}
+
+func (n *clientTrieNode) insert(addr netip.Addr, bits int, view ServersView) {
+	raw := addr.As16()
+	node := n
+	for i := 0; i < bits; i++ {
+		bit := (raw[i/8] >> (7 - uint(i%8))) & 1
+		next := node.children[bit]
+		if next == nil {
+			next = &clientTrieNode{}
+			node.children[bit] = next
+		}
+		node = next
+	}
+	node.view = view
+	node.isLeaf = true
+}
+
+// lookupLongestPrefix returns the view for the deepest (most specific)
+// prefix that contains addr.
+func (n *clientTrieNode) lookupLongestPrefix(addr netip.Addr) (ServersView, bool) {
+	raw := addr.As16()
+	node := n
+	var lastMatch ServersView
+	matched := false
+	if node.isLeaf {
+		lastMatch, matched = node.view, true
+	}
+
+	for i := 0; i < 128; i++ {
+		bit := (raw[i/8] >> (7 - uint(i%8))) & 1
+		next := node.children[bit]
+		if next == nil {
+			break
+		}
+		node = next
+		if node.isLeaf {
+			lastMatch, matched = node.view, true
+		}
+	}
+	return lastMatch, matched
+}
+
+// buildClientRouting resolves the configured ClientRoutes into a single
+// binary trie over the 16-byte (IPv4-mapped for v4) address space, so
+// lookup is a single O(log n) walk regardless of address family.
+func buildClientRouting(routes []ClientRoute, namedPools map[string]ServersView, bootstrap *bootstrapResolver) *clientTrieNode {
+	trie := &clientTrieNode{}
+
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route.CIDR)
+		if err != nil {
+			log.Errorf("Skipping client route: invalid CIDR %q: %s", route.CIDR, err)
+			continue
+		}
+
+		view := resolveClientRouteView(route, namedPools, bootstrap)
+		if len(view) == 0 {
+			log.Warnf("Skipping client route %q: no servers resolved", route.CIDR)
+			continue
+		}
+
+		addr := prefix.Addr()
+		bits := prefix.Bits()
+		if addr.Is4() {
+			// Addr.As16 returns IPv4 addresses in their IPv4-mapped form,
+			// so the prefix bits start 96 bits in.
+			bits += 96
+		}
+		trie.insert(addr, bits, view)
+	}
+
+	return trie
+}
+
+func resolveClientRouteView(route ClientRoute, namedPools map[string]ServersView, bootstrap *bootstrapResolver) ServersView {
+	if route.Pool != "" {
+		return namedPools[route.Pool]
+	}
+
+	view := make(ServersView, 0, len(route.Upstreams))
+	for i := range route.Upstreams {
+		srv := &route.Upstreams[i]
+		transport, err := buildTransport(srv, bootstrap)
+		if err != nil {
+			log.Errorf("Failed to build transport for client route upstream %s: %s", srv.Address, err)
+			continue
+		}
+		srv.transport = transport
+		view = append(view, srv)
+	}
+	return view
+}
+
+// lookupClientRoute returns the ServersView configured for clientIP, if any
+// route's CIDR contains it.
+func lookupClientRoute(trie *clientTrieNode, clientIP string) (ServersView, bool) {
+	if trie == nil || clientIP == "" {
+		return nil, false
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return nil, false
+	}
+	return trie.lookupLongestPrefix(addr)
+}
@@ -0,0 +1,102 @@
+package dnsproxy
+
+import "testing"
+
+func clientAddressOf(t *testing.T, view ServersView, ok bool) string {
+	t.Helper()
+	if !ok {
+		t.Fatalf("expected a client route match, got none")
+	}
+	if len(view) != 1 {
+		t.Fatalf("expected exactly one server in the resolved view, got %d", len(view))
+	}
+	return view[0].Address
+}
+
+func TestLookupClientRouteLongestPrefixWins(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []ClientRoute{
+		{CIDR: "10.2.0.0/16", Upstreams: []UpstreamServer{{Address: "10.0.0.1:53"}}},
+		{CIDR: "10.2.0.0/24", Upstreams: []UpstreamServer{{Address: "10.0.0.2:53"}}},
+	}
+	trie := buildClientRouting(routes, nil, bootstrap)
+
+	view, ok := lookupClientRoute(trie, "10.2.0.10")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.2:53" {
+		t.Errorf("expected the more specific /24 route to win, got %s", got)
+	}
+
+	view, ok = lookupClientRoute(trie, "10.2.1.10")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.1:53" {
+		t.Errorf("expected the /16 route for an address outside the /24, got %s", got)
+	}
+}
+
+func TestLookupClientRouteIPv4AndIPv6(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []ClientRoute{
+		{CIDR: "192.168.1.10/32", Upstreams: []UpstreamServer{{Address: "10.0.0.3:53"}}},
+		{CIDR: "2001:db8::/32", Upstreams: []UpstreamServer{{Address: "10.0.0.4:53"}}},
+	}
+	trie := buildClientRouting(routes, nil, bootstrap)
+
+	view, ok := lookupClientRoute(trie, "192.168.1.10")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.3:53" {
+		t.Errorf("expected the exact-host IPv4 route, got %s", got)
+	}
+
+	view, ok = lookupClientRoute(trie, "2001:db8::1")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.4:53" {
+		t.Errorf("expected the IPv6 route, got %s", got)
+	}
+
+	// A v4 and a v6 route must not cross-match each other's addresses.
+	if _, ok := lookupClientRoute(trie, "192.168.1.11"); ok {
+		t.Errorf("expected no match for an IPv4 address outside the configured /32")
+	}
+	if _, ok := lookupClientRoute(trie, "2001:db9::1"); ok {
+		t.Errorf("expected no match for an IPv6 address outside the configured /32")
+	}
+}
+
+func TestLookupClientRouteUnmatchedAddress(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []ClientRoute{
+		{CIDR: "10.2.0.0/16", Upstreams: []UpstreamServer{{Address: "10.0.0.1:53"}}},
+	}
+	trie := buildClientRouting(routes, nil, bootstrap)
+
+	if _, ok := lookupClientRoute(trie, "192.168.1.1"); ok {
+		t.Errorf("expected no match for an address outside any configured CIDR")
+	}
+}
+
+func TestLookupClientRouteZeroLengthCatchAll(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []ClientRoute{
+		{CIDR: "0.0.0.0/0", Upstreams: []UpstreamServer{{Address: "10.0.0.9:53"}}},
+		{CIDR: "10.2.0.0/16", Upstreams: []UpstreamServer{{Address: "10.0.0.1:53"}}},
+	}
+	trie := buildClientRouting(routes, nil, bootstrap)
+
+	// Nothing more specific matches, so the /0 route catches it.
+	view, ok := lookupClientRoute(trie, "8.8.8.8")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.9:53" {
+		t.Errorf("expected the /0 route to catch an unmatched address, got %s", got)
+	}
+
+	// A more specific prefix still wins over the /0 catch-all.
+	view, ok = lookupClientRoute(trie, "10.2.5.5")
+	if got := clientAddressOf(t, view, ok); got != "10.0.0.1:53" {
+		t.Errorf("expected the /16 route to win over the /0 catch-all, got %s", got)
+	}
+}
+
+func TestLookupClientRouteNoRoutesConfigured(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	trie := buildClientRouting(nil, nil, bootstrap)
+
+	if _, ok := lookupClientRoute(trie, "10.2.5.5"); ok {
+		t.Errorf("expected no match when no client routes are configured")
+	}
+}
@@ -0,0 +1,136 @@
+package dnsproxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/common/log"
+)
+
+// exactMatchPrefix marks a DomainRoute.Domain as requiring an exact QNAME
+// match rather than a suffix match, e.g. "exact:health-check.dns-proxy.".
+const exactMatchPrefix = "exact:"
+
+// DomainRoute maps a domain (suffix or exact) to the upstream pool that
+// should serve it, either inline or by referencing a named pool so the same
+// server list can be shared across several routes.
+type DomainRoute struct {
+	Domain  string           `mapstructure:"Domain"`
+	Pool    string           `mapstructure:"Pool"`
+	Servers []UpstreamServer `mapstructure:"Servers"`
+}
+
+// domainTrieNode is a node of the suffix trie, keyed on one reversed DNS
+// label per level (e.g. "com" -> "example" -> "corp" for "*.corp.example.com").
+type domainTrieNode struct {
+	children map[string]*domainTrieNode
+	view     ServersView
+	isLeaf   bool
+}
+
+func newDomainTrieNode() *domainTrieNode {
+	return &domainTrieNode{children: make(map[string]*domainTrieNode)}
+}
+
+func (n *domainTrieNode) insert(labels []string, view ServersView) {
+	node := n
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		child, ok := node.children[label]
+		if !ok {
+			child = newDomainTrieNode()
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.view = view
+	node.isLeaf = true
+}
+
+// lookupLongestSuffix walks the trie following labels from the TLD down,
+// remembering the deepest (i.e. longest matching suffix) leaf seen.
+func (n *domainTrieNode) lookupLongestSuffix(labels []string) (ServersView, bool) {
+	node := n
+	var lastMatch ServersView
+	matched := false
+	if node.isLeaf {
+		lastMatch, matched = node.view, true
+	}
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.isLeaf {
+			lastMatch, matched = node.view, true
+		}
+	}
+	return lastMatch, matched
+}
+
+// buildDomainRouting resolves the configured DomainRoutes into a suffix trie
+// and an exact-match map. namedPools lets several routes share one server
+// list by referencing DomainRoute.Pool instead of repeating Servers.
+func buildDomainRouting(routes []DomainRoute, namedPools map[string]ServersView, bootstrap *bootstrapResolver) (*domainTrieNode, map[string]ServersView) {
+	trie := newDomainTrieNode()
+	exact := make(map[string]ServersView)
+
+	for _, route := range routes {
+		view := resolveRouteView(route, namedPools, bootstrap)
+		if len(view) == 0 {
+			log.Warnf("Skipping domain route %q: no servers resolved", route.Domain)
+			continue
+		}
+
+		if strings.HasPrefix(route.Domain, exactMatchPrefix) {
+			name := dns.Fqdn(strings.ToLower(strings.TrimPrefix(route.Domain, exactMatchPrefix)))
+			exact[name] = view
+			continue
+		}
+
+		domain := strings.ToLower(strings.TrimPrefix(route.Domain, "."))
+		labels := dns.SplitDomainName(domain)
+		trie.insert(labels, view)
+	}
+
+	return trie, exact
+}
+
+func resolveRouteView(route DomainRoute, namedPools map[string]ServersView, bootstrap *bootstrapResolver) ServersView {
+	if route.Pool != "" {
+		return namedPools[route.Pool]
+	}
+
+	view := make(ServersView, 0, len(route.Servers))
+	for i := range route.Servers {
+		srv := &route.Servers[i]
+		transport, err := buildTransport(srv, bootstrap)
+		if err != nil {
+			log.Errorf("Failed to build transport for domain route upstream %s: %s", srv.Address, err)
+			continue
+		}
+		srv.transport = transport
+		view = append(view, srv)
+	}
+	return view
+}
+
+// lookupDomainRoute returns the ServersView configured for qname, checking
+// exact matches first and then the longest matching suffix. DNS QNAMEs are
+// case-insensitive on the wire (and commonly arrive non-lowercase, e.g.
+// 0x20 encoding), so qname is folded to lowercase to match the routes,
+// which are lowercased the same way when configured.
+func lookupDomainRoute(trie *domainTrieNode, exact map[string]ServersView, qname string) (ServersView, bool) {
+	qname = strings.ToLower(qname)
+
+	if view, ok := exact[dns.Fqdn(qname)]; ok {
+		return view, true
+	}
+	if trie == nil {
+		return nil, false
+	}
+	labels := dns.SplitDomainName(qname)
+	return trie.lookupLongestSuffix(labels)
+}
@@ -0,0 +1,99 @@
+package dnsproxy
+
+import "testing"
+
+func addressOf(t *testing.T, view ServersView, ok bool) string {
+	t.Helper()
+	if !ok {
+		t.Fatalf("expected a domain route match, got none")
+	}
+	if len(view) != 1 {
+		t.Fatalf("expected exactly one server in the resolved view, got %d", len(view))
+	}
+	return view[0].Address
+}
+
+func TestLookupDomainRouteLongestSuffixWins(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []DomainRoute{
+		{Domain: ".example.com", Servers: []UpstreamServer{{Address: "10.0.0.1:53"}}},
+		{Domain: ".corp.example.com", Servers: []UpstreamServer{{Address: "10.0.0.2:53"}}},
+	}
+	trie, exact := buildDomainRouting(routes, nil, bootstrap)
+
+	view, ok := lookupDomainRoute(trie, exact, "host.corp.example.com.")
+	if got := addressOf(t, view, ok); got != "10.0.0.2:53" {
+		t.Errorf("expected the more specific corp.example.com route to win, got %s", got)
+	}
+
+	view, ok = lookupDomainRoute(trie, exact, "host.example.com.")
+	if got := addressOf(t, view, ok); got != "10.0.0.1:53" {
+		t.Errorf("expected the example.com route, got %s", got)
+	}
+
+	if _, ok := lookupDomainRoute(trie, exact, "host.other.com."); ok {
+		t.Errorf("expected no match for an unrelated domain")
+	}
+}
+
+func TestLookupDomainRouteRootCatchAll(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []DomainRoute{
+		{Domain: ".", Servers: []UpstreamServer{{Address: "10.0.0.9:53"}}},
+		{Domain: ".corp.local", Servers: []UpstreamServer{{Address: "10.0.0.2:53"}}},
+	}
+	trie, exact := buildDomainRouting(routes, nil, bootstrap)
+
+	// Nothing more specific matches, so the root route catches it.
+	view, ok := lookupDomainRoute(trie, exact, "anything.example.org.")
+	if got := addressOf(t, view, ok); got != "10.0.0.9:53" {
+		t.Errorf("expected the root route to catch an unmatched domain, got %s", got)
+	}
+
+	// A more specific suffix still wins over the root route.
+	view, ok = lookupDomainRoute(trie, exact, "host.corp.local.")
+	if got := addressOf(t, view, ok); got != "10.0.0.2:53" {
+		t.Errorf("expected the corp.local route to win over root, got %s", got)
+	}
+}
+
+func TestLookupDomainRouteNoRoutesConfigured(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	trie, exact := buildDomainRouting(nil, nil, bootstrap)
+
+	if _, ok := lookupDomainRoute(trie, exact, "anything.example.org."); ok {
+		t.Errorf("expected no match when no domain routes are configured")
+	}
+}
+
+func TestLookupDomainRouteExactMatchTakesPriority(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []DomainRoute{
+		{Domain: ".corp.local", Servers: []UpstreamServer{{Address: "10.0.0.2:53"}}},
+		{Domain: "exact:health-check.corp.local.", Servers: []UpstreamServer{{Address: "10.0.0.3:53"}}},
+	}
+	trie, exact := buildDomainRouting(routes, nil, bootstrap)
+
+	view, ok := lookupDomainRoute(trie, exact, "health-check.corp.local.")
+	if got := addressOf(t, view, ok); got != "10.0.0.3:53" {
+		t.Errorf("expected the exact route to take priority over the suffix route, got %s", got)
+	}
+
+	view, ok = lookupDomainRoute(trie, exact, "other.corp.local.")
+	if got := addressOf(t, view, ok); got != "10.0.0.2:53" {
+		t.Errorf("expected the suffix route for non-exact names, got %s", got)
+	}
+}
+
+func TestLookupDomainRouteCaseInsensitive(t *testing.T) {
+	bootstrap := newBootstrapResolver(nil)
+	routes := []DomainRoute{
+		{Domain: ".Corp.Local", Servers: []UpstreamServer{{Address: "10.0.0.2:53"}}},
+	}
+	trie, exact := buildDomainRouting(routes, nil, bootstrap)
+
+	view, ok := lookupDomainRoute(trie, exact, "Host.CORP.local.")
+	if got := addressOf(t, view, ok); got != "10.0.0.2:53" {
+		t.Errorf("expected a case-insensitive suffix match, got %s", got)
+	}
+}
@@ -0,0 +1,16 @@
+package dnsproxy
+
+// RequestMetadata carries per-query context threaded in from the server
+// layer (the listener that accepted the client's connection) through the
+// engine and into UpstreamsManager.
+type RequestMetadata struct {
+	// Region is the operator-assigned region label for the accepting
+	// listener, used to pick a regional upstream pool.
+	Region string
+
+	// ClientIP is the client's source address (host only, no port), used by
+	// UpstreamSelector to pick an upstream pool by source CIDR. The server
+	// layer must populate this from the connection's remote address before
+	// handing the query to the engine.
+	ClientIP string
+}
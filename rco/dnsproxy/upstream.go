@@ -1,6 +1,7 @@
 package dnsproxy
 
 import (
+	"context"
 	"errors"
 	"github.com/armon/go-metrics"
 	"github.com/miekg/dns"
@@ -12,12 +13,37 @@ import (
 const (
 	ByOrderLB uint8 = iota
 	RoundRobinLB uint8 = iota
+	ParallelBestLB uint8 = iota
+	StrictLB uint8 = iota
 	AllGroupName = "all"
 )
 
+// lbStrategyName returns the metrics label value for a given LBType.
+func lbStrategyName(lbType uint8) string {
+	switch lbType {
+	case RoundRobinLB:
+		return "RoundRobin"
+	case ParallelBestLB:
+		return "ParallelBest"
+	case StrictLB:
+		return "Strict"
+	default:
+		return "ByOrder"
+	}
+}
+
 type UpstreamServer struct {
 	Address     string            `mapstructure:"Address"`
 	Annotations map[string]string `mapstructure:"Annotations"`
+
+	// transport is built once in NewUpstreamsManager from Address's scheme
+	// (udp://, tcp://, tls://host:853, https://host/dns-query) and reused
+	// across queries instead of dialing a fresh connection every exchange.
+	transport upstreamTransport
+
+	// health tracks the active health-check state for this server. nil
+	// means health-checking is disabled, in which case Healthy() is true.
+	health *upstreamHealth
 }
 
 type ServersView []*UpstreamServer
@@ -30,35 +56,93 @@ type UpstreamsManager struct {
 	regionMap        *RegionMap
 	serversRegionMap map[string]ServersView
 
+	// mu guards Servers/serversRegionMap/rrLB.max against concurrent
+	// rotation while the discovery loop refreshes them in the background.
+	mu sync.RWMutex
+
+	// Discoverer, when set, sources Servers at runtime (e.g. from Consul or
+	// a DNS SRV record), replacing the list every DiscoveryInterval. The
+	// static config list is used until the first refresh, one interval after
+	// startup.
+	Discoverer        Discoverer
+	DiscoveryInterval string
+
 	Timeout time.Duration
+
+	// BootstrapDNS is consulted to resolve the hostnames used by tls:// and
+	// https:// upstreams to IPs, since those can't be dialed by hostname
+	// without a working resolver in front of them.
+	BootstrapDNS []string
+	bootstrap    *bootstrapResolver
+
+	// DomainRoutes lets operators send specific domains (suffix or exact)
+	// to a dedicated upstream pool, e.g. "*.corp.local" to an internal
+	// resolver while everything else uses the default upstreams.
+	DomainRoutes []DomainRoute
+	domainTrie   *domainTrieNode
+	domainExact  map[string]ServersView
+
+	// ClientRoutes lets operators send clients in a given source CIDR to a
+	// dedicated upstream pool, e.g. guest-network clients through filtered
+	// upstreams while corp clients use internal resolvers. Checked before
+	// region/all, after DomainRoutes.
+	ClientRoutes []ClientRoute
+	clientTrie   *clientTrieNode
+
+	// HealthCheck configures the background probe loop that ejects an
+	// upstream from rotation after too many consecutive failures.
+	HealthCheck         HealthCheckConfig
+	healthCheckInterval time.Duration
+	healthCheckProbe    *dns.Msg
+
+	// healthMu guards healthCancel, which stops the currently-running
+	// generation of health-check goroutines; replaced whenever the server
+	// set changes (e.g. via discovery) so old probes don't keep running
+	// against servers that are no longer in rotation.
+	healthMu     sync.Mutex
+	healthCancel context.CancelFunc
 }
 
 func NewServerView(size uint) ServersView {
 	return make([]*UpstreamServer, size)
 }
 
-func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *RegionMap, timeout string) *UpstreamsManager {
+func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *RegionMap, timeout string, bootstrapDNS []string, domainRoutes []DomainRoute, namedPools map[string][]UpstreamServer, healthCheck HealthCheckConfig, discoverer Discoverer, discoveryInterval string, clientRoutes []ClientRoute) *UpstreamsManager {
 	usm := new(UpstreamsManager)
 	usm.serversRegionMap = make(map[string]ServersView)
 	usm.Servers = servers
+	usm.BootstrapDNS = bootstrapDNS
+	usm.bootstrap = newBootstrapResolver(bootstrapDNS)
 	var err error
 	usm.Timeout, err = time.ParseDuration(timeout)
 	if err != nil {
 		log.Fatal("Failed to parse Timeout")
 	}
-	if lbType == "RoundRobin" {
+	switch lbType {
+	case "RoundRobin":
 		usm.LBType = RoundRobinLB
 		usm.rrLB = &IndexRoundRobin{
 			current: 0,
 			max: len(usm.Servers),
 		}
-	} else {
+	case "ParallelBest":
+		usm.LBType = ParallelBestLB
+	case "Strict":
+		usm.LBType = StrictLB
+	default:
 		usm.LBType = ByOrderLB
 	}
 	usm.regionMap = regionMap
 
 	for i, _:= range usm.Servers {
 		srv := &(usm.Servers[i])
+		srv.transport, err = buildTransport(srv, usm.bootstrap)
+		if err != nil {
+			log.Errorf("Failed to build transport for upstream %s: %s", srv.Address, err)
+			continue
+		}
+		go healthCheckTransport(srv.Address, srv.transport)
+
 		if region, ok := srv.Annotations["region"]; ok {
 			usm.serversRegionMap[region] = append(usm.serversRegionMap[region], srv)
 		}
@@ -66,6 +150,42 @@ func NewUpstreamsManager(servers []UpstreamServer, lbType string, regionMap *Reg
 		usm.serversRegionMap[AllGroupName] = append(usm.serversRegionMap[AllGroupName], srv)
 	}
 
+	resolvedPools := make(map[string]ServersView, len(namedPools))
+	for name, poolServers := range namedPools {
+		view := make(ServersView, 0, len(poolServers))
+		for i := range poolServers {
+			srv := &poolServers[i]
+			transport, err := buildTransport(srv, usm.bootstrap)
+			if err != nil {
+				log.Errorf("Failed to build transport for named pool %q upstream %s: %s", name, srv.Address, err)
+				continue
+			}
+			srv.transport = transport
+			view = append(view, srv)
+		}
+		resolvedPools[name] = view
+	}
+
+	usm.DomainRoutes = domainRoutes
+	usm.domainTrie, usm.domainExact = buildDomainRouting(domainRoutes, resolvedPools, usm.bootstrap)
+
+	usm.ClientRoutes = clientRoutes
+	usm.clientTrie = buildClientRouting(clientRoutes, resolvedPools, usm.bootstrap)
+
+	usm.HealthCheck = normalizeHealthCheckConfig(healthCheck)
+	usm.startHealthChecks()
+
+	usm.Discoverer = discoverer
+	usm.DiscoveryInterval = discoveryInterval
+	if usm.Discoverer != nil {
+		interval, err := time.ParseDuration(usm.DiscoveryInterval)
+		if err != nil {
+			log.Errorf("Invalid DiscoveryInterval %q, dynamic discovery disabled: %s", usm.DiscoveryInterval, err)
+		} else {
+			usm.startDiscoveryLoop(interval)
+		}
+	}
+
 	return usm
 }
 
@@ -116,24 +236,36 @@ func (usm *UpstreamsManager) buildUpstreamMsg(originReq *dns.Msg, query Query) *
 // Internal function of passing requests to the upstream DNS server
 func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata) *dns.Msg {
 	startTime := time.Now()
-	// Create a DNS client
-	client := new(dns.Client)
 
-	// Make a request to the upstream server
-	var remoteHost string
 	err, servers := usm.UpstreamSelector(req, meta)
 	if err != nil {
 		return nil
 	}
+	// Skip unhealthy upstreams, unless doing so would leave us with none.
+	servers = filterHealthy(servers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), usm.Timeout)
+	defer cancel()
+
+	if usm.LBType == ParallelBestLB {
+		return usm.forwardRequestParallel(ctx, req, servers)
+	}
+
+	// Make a request to the upstream server
+	var srv *UpstreamServer
+	var remoteHost string
 
 	currentTime := time.Now()
 	for i :=0; currentTime.Before(startTime.Add(usm.Timeout)); i++ {
 		if usm.LBType == RoundRobinLB {
-			remoteHost = servers[usm.rrLB.LimitedGet(len(servers))].Address
+			srv = servers[usm.rrLB.LimitedGet(len(servers))]
 		} else {
-			remoteHost = servers[i].Address
+			// ByOrderLB and StrictLB both walk servers strictly in the
+			// configured order, without rotation or shuffling.
+			srv = servers[i%len(servers)]
 		}
-		resp, _, err := client.Exchange(req, remoteHost)
+		remoteHost = srv.Address
+		resp, err := srv.transport.Exchange(ctx, req)
 		if globalConfig.Telemetry.Enabled {
 			metrics.IncrCounterWithLabels([]string{"hoopoe", "request_count"}, 1, []metrics.Label{
 				{
@@ -144,6 +276,7 @@ func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata)
 		}
 
 		if err != nil {
+			usm.recordUpstreamResult(remoteHost, false)
 			if globalConfig.Telemetry.Enabled {
 				metrics.IncrCounterWithLabels([]string{"hoopoe", "request_failed"}, 1, []metrics.Label{
 					{
@@ -154,7 +287,10 @@ func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata)
 			}
 			log.Warnf("Error while contacting server: %s, message: %s", remoteHost, err)
 		} else if len(resp.Answer) > 0 {
+			usm.recordUpstreamResult(remoteHost, true)
 			return resp
+		} else {
+			usm.recordUpstreamResult(remoteHost, false)
 		}
 		currentTime = time.Now()
 	}
@@ -162,8 +298,80 @@ func (usm *UpstreamsManager) forwardRequest(req *dns.Msg, meta RequestMetadata)
 	return nil
 }
 
+// forwardRequestParallel implements the ParallelBest strategy: it fans the
+// request out to every server in the view concurrently and returns the
+// first successful non-empty answer, cancelling the rest.
+func (usm *UpstreamsManager) forwardRequestParallel(ctx context.Context, req *dns.Msg, servers ServersView) *dns.Msg {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		srv  *UpstreamServer
+		resp *dns.Msg
+		err  error
+	}
+
+	results := make(chan result, len(servers))
+	for _, srv := range servers {
+		go func(srv *UpstreamServer) {
+			resp, err := srv.transport.Exchange(ctx, req)
+			results <- result{srv: srv, resp: resp, err: err}
+		}(srv)
+	}
+
+	for range servers {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				usm.recordUpstreamResult(res.srv.Address, false)
+				log.Warnf("Error while contacting server: %s, message: %s", res.srv.Address, res.err)
+				continue
+			}
+			if len(res.resp.Answer) > 0 {
+				usm.recordUpstreamResult(res.srv.Address, true)
+				return res.resp
+			}
+			usm.recordUpstreamResult(res.srv.Address, false)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// recordUpstreamResult tracks per-upstream win/loss counters so operators
+// can see which upstream is consistently fastest/most reliable.
+func (usm *UpstreamsManager) recordUpstreamResult(remoteHost string, won bool) {
+	if !globalConfig.Telemetry.Enabled {
+		return
+	}
+	name := "hoopoe.upstream.loss"
+	if won {
+		name = "hoopoe.upstream.win"
+	}
+	metrics.IncrCounterWithLabels([]string{name}, 1, []metrics.Label{
+		{Name: "strategy", Value: lbStrategyName(usm.LBType)},
+		{Name: "remoteHost", Value: remoteHost},
+	})
+}
+
 // Get Matching Upstream Servers
 func (usm *UpstreamsManager) UpstreamSelector(req *dns.Msg, meta RequestMetadata) (error, ServersView) {
+	// Domain-specific routes take priority over region/all, longest suffix
+	// match wins, "exact:" routes are checked before suffix routes.
+	if view, ok := lookupDomainRoute(usm.domainTrie, usm.domainExact, req.Question[0].Name); ok {
+		return nil, view
+	}
+
+	// Client source CIDR is checked next, longest prefix wins.
+	if view, ok := lookupClientRoute(usm.clientTrie, meta.ClientIP); ok {
+		return nil, view
+	}
+
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+
 	// Skip region checking if region map do not exists
 	if usm.regionMap == nil {
 		goto allServers
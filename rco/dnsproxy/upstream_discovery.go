@@ -0,0 +1,210 @@
+package dnsproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/prometheus/common/log"
+)
+
+// Discoverer sources a pool of upstream servers at runtime, letting
+// UpstreamsManager track upstream fleets that scale without a proxy
+// restart.
+type Discoverer interface {
+	Discover(ctx context.Context) ([]UpstreamServer, error)
+}
+
+// ConsulDiscovererConfig configures discovery via Consul's health-check API.
+type ConsulDiscovererConfig struct {
+	Address     string `mapstructure:"Address"`
+	ServiceName string `mapstructure:"ServiceName"`
+	Datacenter  string `mapstructure:"Datacenter"`
+}
+
+type consulDiscoverer struct {
+	client      *consulapi.Client
+	serviceName string
+}
+
+// NewConsulDiscoverer builds a Discoverer that resolves cfg.ServiceName via
+// Consul's health API, passing through only instances whose health checks
+// are passing.
+func NewConsulDiscoverer(cfg ConsulDiscovererConfig) (Discoverer, error) {
+	clientCfg := consulapi.DefaultConfig()
+	if cfg.Address != "" {
+		clientCfg.Address = cfg.Address
+	}
+	if cfg.Datacenter != "" {
+		clientCfg.Datacenter = cfg.Datacenter
+	}
+
+	client, err := consulapi.NewClient(clientCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Consul client: %w", err)
+	}
+
+	return &consulDiscoverer{client: client, serviceName: cfg.ServiceName}, nil
+}
+
+func (d *consulDiscoverer) Discover(ctx context.Context) ([]UpstreamServer, error) {
+	entries, _, err := d.client.Health().Service(d.serviceName, "", true, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query Consul for service %q: %w", d.serviceName, err)
+	}
+
+	servers := make([]UpstreamServer, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+
+		annotations := make(map[string]string)
+		if entry.Node.Datacenter != "" {
+			annotations["region"] = entry.Node.Datacenter
+		}
+
+		servers = append(servers, UpstreamServer{
+			Address:     fmt.Sprintf("%s:%d", host, entry.Service.Port),
+			Annotations: annotations,
+		})
+	}
+	return servers, nil
+}
+
+// srvDiscoverer resolves upstreams from a DNS SRV record.
+type srvDiscoverer struct {
+	service  string
+	proto    string
+	name     string
+	resolver *net.Resolver
+}
+
+// NewSRVDiscoverer builds a Discoverer that resolves "_service._proto.name"
+// SRV records into host:port upstream entries.
+func NewSRVDiscoverer(service, proto, name string) Discoverer {
+	return &srvDiscoverer{service: service, proto: proto, name: name, resolver: net.DefaultResolver}
+}
+
+func (d *srvDiscoverer) Discover(ctx context.Context) ([]UpstreamServer, error) {
+	_, addrs, err := d.resolver.LookupSRV(ctx, d.service, d.proto, d.name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve SRV record for _%s._%s.%s: %w", d.service, d.proto, d.name, err)
+	}
+
+	servers := make([]UpstreamServer, 0, len(addrs))
+	for _, addr := range addrs {
+		host := strings.TrimSuffix(addr.Target, ".")
+		servers = append(servers, UpstreamServer{
+			Address: fmt.Sprintf("%s:%d", host, addr.Port),
+		})
+	}
+	return servers, nil
+}
+
+// startDiscoveryLoop periodically re-runs usm.Discoverer and swaps in the
+// refreshed server list, rebuilding serversRegionMap under usm.mu so
+// concurrent lookups/rotation stay safe.
+func (usm *UpstreamsManager) startDiscoveryLoop(interval time.Duration) {
+	if usm.Discoverer == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			usm.refreshDiscoveredServers()
+		}
+	}()
+}
+
+func (usm *UpstreamsManager) refreshDiscoveredServers() {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	servers, err := usm.Discoverer.Discover(ctx)
+	if err != nil {
+		log.Warnf("Upstream discovery failed, keeping previous server list: %s", err)
+		return
+	}
+
+	usm.mu.Lock()
+	defer usm.mu.Unlock()
+
+	added, removed := diffServerAddresses(usm.Servers, servers)
+	for _, addr := range added {
+		log.Infof("Discovered new upstream: %s", addr)
+	}
+	for _, addr := range removed {
+		log.Infof("Upstream no longer reported by discovery: %s", addr)
+	}
+
+	// Index the outgoing server list by address so unchanged servers can
+	// carry their transport and, crucially, their upstreamHealth (with its
+	// consecutive-failure/recovery counters) forward instead of starting
+	// over every refresh.
+	oldByAddr := make(map[string]*UpstreamServer, len(usm.Servers))
+	for i := range usm.Servers {
+		oldByAddr[usm.Servers[i].Address] = &usm.Servers[i]
+	}
+
+	regionMap := make(map[string]ServersView)
+	for i := range servers {
+		srv := &servers[i]
+
+		if old, ok := oldByAddr[srv.Address]; ok && old.transport != nil {
+			srv.transport = old.transport
+			srv.health = old.health
+		} else {
+			transport, err := buildTransport(srv, usm.bootstrap)
+			if err != nil {
+				log.Errorf("Failed to build transport for discovered upstream %s: %s", srv.Address, err)
+				continue
+			}
+			srv.transport = transport
+		}
+
+		if region, ok := srv.Annotations["region"]; ok {
+			regionMap[region] = append(regionMap[region], srv)
+		}
+		regionMap[AllGroupName] = append(regionMap[AllGroupName], srv)
+	}
+
+	usm.Servers = servers
+	usm.serversRegionMap = regionMap
+	if usm.rrLB != nil {
+		usm.rrLB.max = len(usm.Servers)
+	}
+
+	// Stop the previous generation's health-check goroutines (they'd
+	// otherwise keep probing servers discovery just dropped) and start a
+	// fresh one so newly discovered servers are actually monitored.
+	usm.restartHealthChecks()
+}
+
+func diffServerAddresses(oldServers, newServers []UpstreamServer) (added, removed []string) {
+	oldSet := make(map[string]bool, len(oldServers))
+	for _, srv := range oldServers {
+		oldSet[srv.Address] = true
+	}
+	newSet := make(map[string]bool, len(newServers))
+	for _, srv := range newServers {
+		newSet[srv.Address] = true
+		if !oldSet[srv.Address] {
+			added = append(added, srv.Address)
+		}
+	}
+	for _, srv := range oldServers {
+		if !newSet[srv.Address] {
+			removed = append(removed, srv.Address)
+		}
+	}
+	return added, removed
+}
+
+const discoveryTimeout = 10 * time.Second
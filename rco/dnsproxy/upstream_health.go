@@ -0,0 +1,215 @@
+package dnsproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/miekg/dns"
+	"github.com/prometheus/common/log"
+)
+
+// HealthCheckConfig controls the active health-checking loop that probes
+// every server of UpstreamsManager.Servers in the background and ejects it
+// from rotation once it fails enough consecutive checks. Servers listed only
+// in domain routes, client routes or named pools are not probed and always
+// count as healthy.
+type HealthCheckConfig struct {
+	Enabled          bool   `mapstructure:"Enabled"`
+	CheckInterval    string `mapstructure:"CheckInterval"`
+	FailThreshold    int    `mapstructure:"FailThreshold"`
+	RecoverThreshold int    `mapstructure:"RecoverThreshold"`
+	CheckQuery       string `mapstructure:"CheckQuery"`
+}
+
+const (
+	defaultCheckQuery       = "health-check.dns-proxy."
+	defaultFailThreshold    = 3
+	defaultRecoverThreshold = 2
+)
+
+// upstreamHealth tracks the consecutive pass/fail state of a single
+// upstream. Servers start healthy so a slow first probe doesn't eject an
+// otherwise-fine upstream before it has been checked.
+type upstreamHealth struct {
+	sync.Mutex
+
+	healthy             bool
+	consecutiveFailures int
+	consecutiveOK       int
+}
+
+func (h *upstreamHealth) isHealthy() bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.healthy
+}
+
+// recordResult applies one probe result and reports whether the health
+// state flipped (used to decide whether to log/emit a metric).
+func (h *upstreamHealth) recordResult(ok bool, failThreshold, recoverThreshold int) (changed bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if ok {
+		h.consecutiveFailures = 0
+		h.consecutiveOK++
+		if !h.healthy && h.consecutiveOK >= recoverThreshold {
+			h.healthy = true
+			return true
+		}
+		return false
+	}
+
+	h.consecutiveOK = 0
+	h.consecutiveFailures++
+	if h.healthy && h.consecutiveFailures >= failThreshold {
+		h.healthy = false
+		return true
+	}
+	return false
+}
+
+// Healthy reports whether srv is currently in rotation: it turns false after
+// FailThreshold consecutive failed health-checks and true again after
+// RecoverThreshold consecutive passes. A server that was never
+// health-checked is considered healthy.
+func (srv *UpstreamServer) Healthy() bool {
+	if srv.health == nil {
+		return true
+	}
+	return srv.health.isHealthy()
+}
+
+func normalizeHealthCheckConfig(cfg HealthCheckConfig) HealthCheckConfig {
+	if cfg.CheckInterval == "" {
+		cfg.CheckInterval = "10s"
+	}
+	if cfg.FailThreshold <= 0 {
+		cfg.FailThreshold = defaultFailThreshold
+	}
+	if cfg.RecoverThreshold <= 0 {
+		cfg.RecoverThreshold = defaultRecoverThreshold
+	}
+	if cfg.CheckQuery == "" {
+		cfg.CheckQuery = defaultCheckQuery
+	}
+	return cfg
+}
+
+// startHealthChecks parses the interval/probe config once and launches the
+// first generation of health-check goroutines over usm.Servers.
+func (usm *UpstreamsManager) startHealthChecks() {
+	if !usm.HealthCheck.Enabled {
+		return
+	}
+
+	interval, err := time.ParseDuration(usm.HealthCheck.CheckInterval)
+	if err != nil {
+		log.Errorf("Invalid HealthCheck.CheckInterval %q, health-checking disabled: %s", usm.HealthCheck.CheckInterval, err)
+		return
+	}
+
+	probe := new(dns.Msg)
+	probe.SetQuestion(dns.Fqdn(usm.HealthCheck.CheckQuery), dns.TypeA)
+	if usm.HealthCheck.CheckQuery == "." {
+		probe.SetQuestion(".", dns.TypeNS)
+	}
+
+	usm.healthCheckInterval = interval
+	usm.healthCheckProbe = probe
+
+	usm.restartHealthChecks()
+}
+
+// restartHealthChecks stops whichever generation of health-check goroutines
+// is currently running and starts a fresh one over the current usm.Servers.
+// Call this again any time the server set changes (e.g. after a discovery
+// refresh) so newly added servers get probed and goroutines for servers
+// that are no longer in rotation are stopped rather than leaked.
+func (usm *UpstreamsManager) restartHealthChecks() {
+	if !usm.HealthCheck.Enabled || usm.healthCheckProbe == nil {
+		return
+	}
+
+	usm.healthMu.Lock()
+	if usm.healthCancel != nil {
+		usm.healthCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	usm.healthCancel = cancel
+	usm.healthMu.Unlock()
+
+	for i := range usm.Servers {
+		srv := &usm.Servers[i]
+		// A server carried over from a previous generation (e.g. by
+		// refreshDiscoveredServers, keyed by address) already has its
+		// upstreamHealth set, preserving its consecutive-failure/recovery
+		// counters; only allocate a fresh one for servers seeing
+		// health-checking for the first time.
+		if srv.health == nil {
+			srv.health = &upstreamHealth{healthy: true}
+		}
+		go usm.runHealthCheckLoop(ctx, srv, usm.healthCheckProbe, usm.healthCheckInterval)
+	}
+}
+
+func (usm *UpstreamsManager) runHealthCheckLoop(ctx context.Context, srv *UpstreamServer, probe *dns.Msg, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if srv.transport == nil {
+			continue
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		_, err := srv.transport.Exchange(checkCtx, probe)
+		cancel()
+
+		changed := srv.health.recordResult(err == nil, usm.HealthCheck.FailThreshold, usm.HealthCheck.RecoverThreshold)
+		if !changed {
+			continue
+		}
+
+		if srv.health.isHealthy() {
+			log.Infof("Upstream %s recovered, re-entering rotation", srv.Address)
+			usm.emitHealthGauge(srv.Address, "hoopoe.upstream.up")
+		} else {
+			log.Warnf("Upstream %s ejected after %d consecutive failed health-checks", srv.Address, usm.HealthCheck.FailThreshold)
+			usm.emitHealthGauge(srv.Address, "hoopoe.upstream.down")
+		}
+	}
+}
+
+func (usm *UpstreamsManager) emitHealthGauge(remoteHost, metric string) {
+	if !globalConfig.Telemetry.Enabled {
+		return
+	}
+	metrics.SetGaugeWithLabels([]string{metric}, 1, []metrics.Label{
+		{Name: "remoteHost", Value: remoteHost},
+	})
+}
+
+// filterHealthy returns only the healthy servers in view, falling back to
+// the full view if every server is currently unhealthy so callers never see
+// an empty ServersView.
+func filterHealthy(view ServersView) ServersView {
+	healthy := make(ServersView, 0, len(view))
+	for _, srv := range view {
+		if srv.Healthy() {
+			healthy = append(healthy, srv)
+		}
+	}
+	if len(healthy) == 0 {
+		return view
+	}
+	return healthy
+}
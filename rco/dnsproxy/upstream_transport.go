@@ -0,0 +1,359 @@
+package dnsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	udpScheme   = "udp"
+	tcpScheme   = "tcp"
+	tlsScheme   = "tls"
+	httpsScheme = "https"
+
+	dohContentType = "application/dns-message"
+
+	bootstrapTTL = 5 * time.Minute
+)
+
+// upstreamTransport exchanges a DNS message with a single upstream server.
+type upstreamTransport interface {
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// bootstrapResolver resolves the hostnames used by DoT/DoH upstreams to IPs,
+// caching the result for bootstrapTTL so we don't depend on the upstream
+// itself (or a broken resolver) to look itself up.
+type bootstrapResolver struct {
+	sync.Mutex
+
+	servers []string
+	cache   map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	ip      string
+	expires time.Time
+}
+
+func newBootstrapResolver(servers []string) *bootstrapResolver {
+	return &bootstrapResolver{
+		servers: servers,
+		cache:   make(map[string]bootstrapEntry),
+	}
+}
+
+// Resolve returns a cached IP for host, looking it up via the configured
+// BootstrapDNS servers if the cache is empty or expired.
+func (b *bootstrapResolver) Resolve(host string) (string, error) {
+	b.Lock()
+	if entry, ok := b.cache[host]; ok && time.Now().Before(entry.expires) {
+		b.Unlock()
+		return entry.ip, nil
+	}
+	b.Unlock()
+
+	ip, err := b.lookup(host)
+	if err != nil {
+		return "", err
+	}
+
+	b.Lock()
+	b.cache[host] = bootstrapEntry{ip: ip, expires: time.Now().Add(bootstrapTTL)}
+	b.Unlock()
+	return ip, nil
+}
+
+func (b *bootstrapResolver) lookup(host string) (string, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return host, nil
+	}
+	if len(b.servers) == 0 {
+		return "", fmt.Errorf("no BootstrapDNS configured to resolve %s", host)
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	client := new(dns.Client)
+
+	var lastErr error
+	for _, bootstrap := range b.servers {
+		resp, _, err := client.Exchange(m, bootstrap)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ans := range resp.Answer {
+			if a, ok := ans.(*dns.A); ok {
+				return a.A.String(), nil
+			}
+		}
+	}
+	if lastErr != nil {
+		return "", fmt.Errorf("failed to resolve %s via BootstrapDNS: %w", host, lastErr)
+	}
+	return "", fmt.Errorf("no A record found for %s via BootstrapDNS", host)
+}
+
+// parseUpstreamAddress splits an UpstreamServer.Address of the form
+// "scheme://host[:port][/path]" into its scheme and the remainder. Addresses
+// with no scheme are treated as plain udp, matching the historical behaviour.
+func parseUpstreamAddress(address string) (scheme string, rest string) {
+	if !strings.Contains(address, "://") {
+		return udpScheme, address
+	}
+	parts := strings.SplitN(address, "://", 2)
+	return parts[0], parts[1]
+}
+
+// buildTransport constructs the upstreamTransport for srv based on its
+// Address scheme, resolving DoT/DoH hostnames via bootstrap.
+func buildTransport(srv *UpstreamServer, bootstrap *bootstrapResolver) (upstreamTransport, error) {
+	scheme, rest := parseUpstreamAddress(srv.Address)
+
+	switch scheme {
+	case tlsScheme:
+		return newDotTransport(rest, bootstrap)
+	case httpsScheme:
+		return newDohTransport(rest, bootstrap)
+	case tcpScheme:
+		return &classicTransport{net: "tcp", addr: rest}, nil
+	case udpScheme:
+		return &classicTransport{net: "udp", addr: rest}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q for address %q", scheme, srv.Address)
+	}
+}
+
+// classicTransport exchanges over plain udp/tcp using a shared dns.Client.
+type classicTransport struct {
+	net  string
+	addr string
+
+	client *dns.Client
+	once   sync.Once
+}
+
+func (t *classicTransport) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	t.once.Do(func() {
+		t.client = &dns.Client{Net: t.net}
+	})
+	resp, _, err := t.client.ExchangeContext(ctx, req, t.addr)
+	return resp, err
+}
+
+// dotPoolSize bounds how many persistent DoT connections a single upstream
+// keeps warm. Concurrent callers (regular queries, the chunk0-4 health-check
+// ticker, and chunk0-2's ParallelBest fan-out) borrow a connection from this
+// pool instead of serializing behind one shared connection, and redial
+// (re-resolving the bootstrap IP) whenever a borrowed connection errors.
+const dotPoolSize = 8
+
+// dotTransport exchanges over DNS-over-TLS, keeping a small pool of
+// persistent *dns.Conn alive across queries instead of dialing (and
+// re-handshaking TLS) on every exchange, which is exactly what
+// dns.Client.Exchange does internally.
+type dotTransport struct {
+	host string
+	port string
+
+	bootstrap *bootstrapResolver
+	client    *dns.Client
+	pool      chan *dns.Conn
+}
+
+func newDotTransport(hostport string, bootstrap *bootstrapResolver) (*dotTransport, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+		port = "853"
+	}
+
+	// Fail fast at startup if the hostname can't be resolved at all; the
+	// result is cached in bootstrap so this doesn't waste the lookup.
+	if _, err := bootstrap.Resolve(host); err != nil {
+		return nil, err
+	}
+
+	return &dotTransport{
+		host:      host,
+		port:      port,
+		bootstrap: bootstrap,
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: &tls.Config{ServerName: host},
+		},
+		pool: make(chan *dns.Conn, dotPoolSize),
+	}, nil
+}
+
+func (t *dotTransport) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, err := t.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, _, err := t.client.ExchangeWithConnContext(ctx, req, conn)
+	if err != nil {
+		conn.Close()
+		var dialErr error
+		conn, dialErr = t.dial(ctx)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		resp, _, err = t.client.ExchangeWithConnContext(ctx, req, conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	t.putConn(conn)
+	return resp, nil
+}
+
+// getConn borrows an idle connection from the pool, dialing a fresh one if
+// none is currently idle.
+func (t *dotTransport) getConn(ctx context.Context) (*dns.Conn, error) {
+	select {
+	case conn := <-t.pool:
+		return conn, nil
+	default:
+		return t.dial(ctx)
+	}
+}
+
+// putConn returns conn to the pool for reuse, closing it instead if the pool
+// is already full so the transport never keeps more than dotPoolSize
+// connections warm.
+func (t *dotTransport) putConn(conn *dns.Conn) {
+	select {
+	case t.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// dial establishes a new persistent connection, re-resolving the bootstrap
+// IP so a DNS-level change in the upstream's address is picked up on
+// reconnect rather than baked in for the transport's lifetime.
+func (t *dotTransport) dial(ctx context.Context) (*dns.Conn, error) {
+	ip, err := t.bootstrap.Resolve(t.host)
+	if err != nil {
+		return nil, err
+	}
+	return t.client.DialContext(ctx, net.JoinHostPort(ip, t.port))
+}
+
+// dohTransport exchanges over DNS-over-HTTPS using a shared http.Client so
+// the underlying HTTP/2 connection is reused between queries.
+type dohTransport struct {
+	url string
+
+	httpClient *http.Client
+}
+
+func newDohTransport(hostAndPath string, bootstrap *bootstrapResolver) (*dohTransport, error) {
+	host := hostAndPath
+	if idx := strings.Index(hostAndPath, "/"); idx >= 0 {
+		host = hostAndPath[:idx]
+	}
+	hostOnly := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostOnly = h
+	}
+
+	// Fail fast at startup if the hostname can't be resolved at all; the
+	// result is cached in bootstrap so this doesn't waste the lookup.
+	if _, err := bootstrap.Resolve(hostOnly); err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{}
+	transport := &http.Transport{
+		ForceAttemptHTTP2: true,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				port = "443"
+			}
+			// Re-resolved on every (re)connect, not just once at transport
+			// construction, so an IP change is picked up without a restart.
+			ip, err := bootstrap.Resolve(hostOnly)
+			if err != nil {
+				return nil, err
+			}
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err != nil {
+				return nil, err
+			}
+			return tls.Client(conn, &tls.Config{ServerName: hostOnly, NextProtos: []string{"h2", "http/1.1"}}), nil
+		},
+	}
+
+	return &dohTransport{
+		url:        "https://" + hostAndPath,
+		httpClient: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (t *dohTransport) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	packed, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohContentType)
+	httpReq.Header.Set("Accept", dohContentType)
+
+	httpResp, err := t.httpClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH query to %s failed with status %s", t.url, httpResp.Status)
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// healthCheckTransport issues a cheap probe query to confirm the transport
+// is reachable. It's called once at startup for each server of the static
+// UpstreamsManager.Servers list; servers from domain routes, client routes,
+// named pools or discovery are not probed this way.
+func healthCheckTransport(name string, t upstreamTransport) {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := t.Exchange(ctx, probe); err != nil {
+		log.Warnf("Upstream %s failed startup health-check: %s", name, err)
+	}
+}